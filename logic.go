@@ -4,15 +4,87 @@ package logic
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v2"
 )
 
+//Format identifies the serialization used to read or write an Expression.
+type Format int
+
+//The supported formats for LoadFormat/ParseFormat and SaveFormat.
+const (
+	YAML Format = iota
+	JSON
+	TOML
+)
+
+//Matcher is a custom predicate against a feature set. Registering a Matcher
+//factory under a prefix (see RegisterMatcher) lets a YAML/JSON/TOML token of
+//the form "@prefix:arg" dispatch to it instead of the built-in equality/regex
+//matching in eval.
+type Matcher interface {
+	Match(features []string) bool
+}
+
+var (
+	matcherRegistryMu sync.RWMutex
+	matcherRegistry   = map[string]func(arg string) (Matcher, error){}
+)
+
+//RegisterMatcher registers a Matcher factory under prefix, so that a token
+//"@prefix:arg" is resolved and compiled, via factory(arg), whenever it is
+//encountered by load or by the builder functions (AllOf, AnyOf, NoneOf, NOf).
+//A bad arg is expected to surface as an error from factory, which is then
+//reported as a parse error (load) or by Validate (builders) rather than at
+//Eval time. RegisterMatcher is safe to call concurrently with
+//itself and with Load/Parse/Validate, e.g. from an init function in a
+//matcher-providing package.
+func RegisterMatcher(prefix string, factory func(arg string) (Matcher, error)) {
+	matcherRegistryMu.Lock()
+	defer matcherRegistryMu.Unlock()
+	matcherRegistry[prefix] = factory
+}
+
+//matcherToken pairs a compiled Matcher with the raw "@prefix:arg" token it was
+//compiled from, so Expression can round-trip back to that token on export.
+type matcherToken struct {
+	label string
+	m     Matcher
+}
+
+//parseMatcherToken splits a "@prefix:arg" token into prefix and arg. It
+//reports ok=false for anything not shaped like a matcher token, so callers
+//can fall back to treating it as a plain feature string.
+func parseMatcherToken(token string) (prefix string, arg string, ok bool) {
+	if !strings.HasPrefix(token, "@") {
+		return "", "", false
+	}
+	rest := token[1:]
+	i := strings.Index(rest, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+func compileMatcher(prefix, arg string) (Matcher, error) {
+	matcherRegistryMu.RLock()
+	factory, ok := matcherRegistry[prefix]
+	matcherRegistryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown matcher prefix: %q", prefix)
+	}
+	return factory(arg)
+}
+
 //Expression represents a logic operation, which can be: "all_of" ("and"), "any_of" ("or"),
 //"none_of" ("not") or "n of", where n is a non-negative integer. If n equals 0, it is same
 //as "none_of"; if n is 1, same as "any_of" or "or"; if n equal to the number of items,
@@ -23,7 +95,8 @@ import (
 //feature (string) or a (sub)Expression.
 //
 //If a feature string starts with tilde (~), its a regular expression, otherwise, a raw
-//string (which is case sensitive).
+//string (which is case sensitive). Regular expressions are compiled once, when the
+//Expression is loaded, so a value is safe for concurrent reuse across many Eval calls.
 type Expression struct {
 	verb string
 	rate int
@@ -37,9 +110,12 @@ func (x *Expression) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
-	p, err := load(ms)
+	p, err := load(normalize(ms).(map[string]interface{}))
+	if err != nil {
+		return err
+	}
 	*x = *p
-	return err
+	return nil
 }
 
 //MarshalYAML implements the yaml marshal interface
@@ -53,6 +129,10 @@ func (x Expression) export() map[string]interface{} {
 		switch s.(type) {
 		case string:
 			subj = append(subj, s)
+		case *regexp.Regexp:
+			subj = append(subj, "~"+s.(*regexp.Regexp).String())
+		case matcherToken:
+			subj = append(subj, s.(matcherToken).label)
 		case *Expression:
 			e := s.(*Expression).export()
 			if e == nil {
@@ -68,7 +148,31 @@ func (x Expression) export() map[string]interface{} {
 
 //Save writes the logic expression as YAML string to the given writer.
 func (x Expression) Save(w io.Writer) error {
-	return yaml.NewEncoder(w).Encode(x.export())
+	return x.SaveFormat(w, YAML)
+}
+
+//SaveJSON writes the logic expression as JSON to the given writer.
+func (x Expression) SaveJSON(w io.Writer) error {
+	return x.SaveFormat(w, JSON)
+}
+
+//SaveTOML writes the logic expression as TOML to the given writer.
+func (x Expression) SaveTOML(w io.Writer) error {
+	return x.SaveFormat(w, TOML)
+}
+
+//SaveFormat writes the logic expression to the given writer, encoded in the given format.
+func (x Expression) SaveFormat(w io.Writer, f Format) error {
+	switch f {
+	case YAML:
+		return yaml.NewEncoder(w).Encode(x.export())
+	case JSON:
+		return json.NewEncoder(w).Encode(x.export())
+	case TOML:
+		return toml.NewEncoder(w).Encode(x.export())
+	default:
+		return fmt.Errorf("unsupported format: %v", f)
+	}
 }
 
 //String output the logic expression as YAML string.
@@ -78,7 +182,62 @@ func (x Expression) String() string {
 	return buf.String()
 }
 
-func load(ms map[interface{}]interface{}) (*Expression, error) {
+//normalize walks a decoded document and converts any map[interface{}]interface{}
+//(as produced by yaml.v2) into map[string]interface{}, so load can work against
+//a single canonical structure regardless of which decoder produced it.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = normalize(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = normalize(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+//decode reads r with the decoder for format f and returns the canonical,
+//string-keyed structure consumed by load.
+func decode(r io.Reader, f Format) (map[string]interface{}, error) {
+	switch f {
+	case YAML:
+		var ms map[interface{}]interface{}
+		if err := yaml.NewDecoder(r).Decode(&ms); err != nil {
+			return nil, err
+		}
+		return normalize(ms).(map[string]interface{}), nil
+	case JSON:
+		var ms map[string]interface{}
+		if err := json.NewDecoder(r).Decode(&ms); err != nil {
+			return nil, err
+		}
+		return ms, nil
+	case TOML:
+		var ms map[string]interface{}
+		if _, err := toml.NewDecoder(r).Decode(&ms); err != nil {
+			return nil, err
+		}
+		return ms, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %v", f)
+	}
+}
+
+func load(ms map[string]interface{}) (*Expression, error) {
 	if len(ms) != 1 {
 		return nil, fmt.Errorf("expect 1 verb, got %d", len(ms))
 	}
@@ -86,7 +245,7 @@ func load(ms map[interface{}]interface{}) (*Expression, error) {
 	var r int
 	var s []interface{}
 	for verb, subj := range ms {
-		v = verb.(string)
+		v = verb
 		switch v {
 		case "not", "none_of":
 			v = "none_of"
@@ -117,9 +276,26 @@ func load(ms map[interface{}]interface{}) (*Expression, error) {
 		for _, j := range js {
 			switch j.(type) {
 			case string:
+				token := j.(string)
+				if strings.HasPrefix(token, "~") {
+					rx, err := regexp.Compile(token[1:])
+					if err != nil {
+						return nil, fmt.Errorf("invalid regex %q: %v", token, err)
+					}
+					s = append(s, rx)
+					break
+				}
+				if prefix, arg, ok := parseMatcherToken(token); ok {
+					m, err := compileMatcher(prefix, arg)
+					if err != nil {
+						return nil, fmt.Errorf("invalid matcher %q: %v", token, err)
+					}
+					s = append(s, matcherToken{label: token, m: m})
+					break
+				}
 				s = append(s, j)
-			case map[interface{}]interface{}:
-				o, err := load(j.(map[interface{}]interface{}))
+			case map[string]interface{}:
+				o, err := load(j.(map[string]interface{}))
 				if err != nil {
 					return nil, err
 				}
@@ -147,8 +323,14 @@ func load(ms map[interface{}]interface{}) (*Expression, error) {
 //The above YAML defines "item1 and (item2 or item3)".  For more examples,
 //see the test file.
 func Load(r io.Reader) (*Expression, error) {
-	var ms map[interface{}]interface{}
-	err := yaml.NewDecoder(r).Decode(&ms)
+	return LoadFormat(r, YAML)
+}
+
+//LoadFormat reads r and parses it as a logic expression encoded in the given
+//format (YAML, JSON or TOML). The grammar is the same for every format, only
+//the on-the-wire shape differs; see Load for the grammar.
+func LoadFormat(r io.Reader, f Format) (*Expression, error) {
+	ms, err := decode(r, f)
 	if err != nil {
 		return nil, err
 	}
@@ -157,37 +339,53 @@ func Load(r io.Reader) (*Expression, error) {
 
 //Parse parse the given YAML string as logic expression.
 func Parse(exp string) (*Expression, error) {
-	return Load(bytes.NewBufferString(exp))
+	return ParseFormat(exp, YAML)
 }
 
-func eval(token string, featrues []string) bool {
-	if strings.HasPrefix(token, "~") {
-		rx := regexp.MustCompile(token[1:])
-		for _, f := range featrues {
-			if rx.MatchString(f) {
-				return true
-			}
+//ParseFormat parses the given string as a logic expression encoded in the given format.
+func ParseFormat(exp string, f Format) (*Expression, error) {
+	return LoadFormat(bytes.NewBufferString(exp), f)
+}
+
+func eval(token string, features []string) bool {
+	for _, f := range features {
+		if f == token {
+			return true
 		}
-		return false
 	}
-	for _, f := range featrues {
-		if f == token {
+	return false
+}
+
+func evalRegex(rx *regexp.Regexp, features []string) bool {
+	for _, f := range features {
+		if rx.MatchString(f) {
 			return true
 		}
 	}
 	return false
 }
 
+func evalSubj(s interface{}, features []string) bool {
+	switch v := s.(type) {
+	case string:
+		return eval(v, features)
+	case *regexp.Regexp:
+		return evalRegex(v, features)
+	case matcherToken:
+		return v.m.Match(features)
+	case *Expression:
+		return v.Eval(features)
+	default:
+		//an invalidOperand (or anything else that isn't a recognized,
+		//compiled leaf type) can only reach here if Validate was skipped;
+		//treat it as non-matching rather than panicking.
+		return false
+	}
+}
+
 func (x Expression) evalNeg(subj []interface{}, features []string) bool {
 	for _, s := range subj {
-		var res bool
-		switch s.(type) {
-		case string:
-			res = eval(s.(string), features)
-		default:
-			res = s.(*Expression).Eval(features)
-		}
-		if res {
+		if evalSubj(s, features) {
 			return false
 		}
 	}
@@ -201,14 +399,7 @@ func (x Expression) evalPos(subj []interface{}, features []string) bool {
 	}
 	hit := 0
 	for _, s := range subj {
-		var res bool
-		switch s.(type) {
-		case string:
-			res = eval(s.(string), features)
-		default:
-			res = s.(*Expression).Eval(features)
-		}
-		if res {
+		if evalSubj(s, features) {
 			hit++
 		}
 		if hit >= rate {
@@ -227,3 +418,401 @@ func (x Expression) Eval(features []string) bool {
 		return x.evalPos(x.subj, features)
 	}
 }
+
+//FeatureSet is a feature set with fast membership testing, for callers that
+//have a more efficient representation than a plain []string. Has is used for
+//plain and "key=value" tokens; Iter is used for the regex and matcher token
+//paths, which must scan every feature.
+type FeatureSet interface {
+	Has(feature string) bool
+	Iter() []string
+}
+
+//sliceFeatureSet is immutable after construction, so its Iter result is
+//precomputed once rather than rebuilt from the map on every regex/matcher
+//token evaluated against it.
+type sliceFeatureSet struct {
+	has  map[string]struct{}
+	iter []string
+}
+
+func (s sliceFeatureSet) Has(feature string) bool {
+	_, ok := s.has[feature]
+	return ok
+}
+
+func (s sliceFeatureSet) Iter() []string {
+	return s.iter
+}
+
+//NewFeatureSet builds a FeatureSet backed by a map, giving Eval-equivalent
+//queries O(1) membership lookups instead of the O(n) scan that Eval does
+//against a plain []string.
+func NewFeatureSet(features []string) FeatureSet {
+	has := make(map[string]struct{}, len(features))
+	for _, f := range features {
+		has[f] = struct{}{}
+	}
+	return sliceFeatureSet{has: has, iter: features}
+}
+
+//mapFeatureSet backs a FeatureSet with key/value pairs, so that a "key=value"
+//token in the expression matches the value stored under "key", rather than
+//being compared as one opaque string. Like sliceFeatureSet, it is immutable
+//after construction, so Iter is precomputed once.
+type mapFeatureSet struct {
+	kv   map[string]string
+	iter []string
+}
+
+func splitKV(token string) (key, val string, ok bool) {
+	i := strings.Index(token, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	return token[:i], token[i+1:], true
+}
+
+func (m mapFeatureSet) Has(token string) bool {
+	k, v, ok := splitKV(token)
+	if !ok {
+		//a mapFeatureSet only has "key=value" features (see Iter); a bare
+		//token never matches, even if it happens to equal some key's name.
+		return false
+	}
+	mv, found := m.kv[k]
+	return found && mv == v
+}
+
+func (m mapFeatureSet) Iter() []string {
+	return m.iter
+}
+
+//NewFeatureMap builds a FeatureSet over key/value pairs, enabling expressions
+//whose tokens are of the form "key=value", e.g. "env=prod and (region=us-east
+//or region=eu-west)".
+func NewFeatureMap(kv map[string]string) FeatureSet {
+	iter := make([]string, 0, len(kv))
+	for k, v := range kv {
+		iter = append(iter, k+"="+v)
+	}
+	return mapFeatureSet{kv: kv, iter: iter}
+}
+
+func evalSubjSet(s interface{}, features FeatureSet) bool {
+	switch v := s.(type) {
+	case string:
+		return features.Has(v)
+	case *regexp.Regexp:
+		return evalRegex(v, features.Iter())
+	case matcherToken:
+		return v.m.Match(features.Iter())
+	case *Expression:
+		return v.EvalSet(features)
+	default:
+		//see evalSubj: an unvalidated invalidOperand is non-matching, not a panic.
+		return false
+	}
+}
+
+func (x Expression) evalNegSet(subj []interface{}, features FeatureSet) bool {
+	for _, s := range subj {
+		if evalSubjSet(s, features) {
+			return false
+		}
+	}
+	return true
+}
+
+func (x Expression) evalPosSet(subj []interface{}, features FeatureSet) bool {
+	rate := x.rate
+	if rate < 0 {
+		rate = len(subj)
+	}
+	hit := 0
+	for _, s := range subj {
+		if evalSubjSet(s, features) {
+			hit++
+		}
+		if hit >= rate {
+			return true
+		}
+	}
+	return false
+}
+
+//EvalSet evaluates the given FeatureSet against the logic expression. It is
+//the FeatureSet counterpart of Eval, for callers holding features in a form
+//that already supports fast lookup (or key/value semantics via NewFeatureMap)
+//rather than a plain []string.
+func (x Expression) EvalSet(features FeatureSet) bool {
+	switch x.verb {
+	case "none_of":
+		return x.evalNegSet(x.subj, features)
+	default:
+		return x.evalPosSet(x.subj, features)
+	}
+}
+
+//Trace is the result of Explain: a tree mirroring the shape of the Expression
+//it was produced from, annotated with the outcome of evaluating each node (and
+//leaf) against a feature set.
+type Trace struct {
+	Label   string   //the verb (for a sub-expression) or the token (for a leaf)
+	Result  bool     //whether this node matched the evaluated feature set
+	Leaf    bool     //true if this node is a feature/regex token rather than a sub-expression
+	Hit     int      //for a non-all_of/none_of verb, the number of matching items
+	Rate    int      //for a non-all_of/none_of verb, the required number of matching items
+	Matched []string //for a regex leaf, the feature strings it matched
+	Items   []*Trace //the traced operands, in order, for a sub-expression node
+}
+
+func explainSubj(s interface{}, features []string) *Trace {
+	switch v := s.(type) {
+	case string:
+		return &Trace{Label: v, Leaf: true, Result: eval(v, features)}
+	case *regexp.Regexp:
+		var matched []string
+		for _, f := range features {
+			if v.MatchString(f) {
+				matched = append(matched, f)
+			}
+		}
+		return &Trace{Label: "~" + v.String(), Leaf: true, Result: len(matched) > 0, Matched: matched}
+	case matcherToken:
+		return &Trace{Label: v.label, Leaf: true, Result: v.m.Match(features)}
+	case *Expression:
+		return v.Explain(features)
+	default:
+		//see evalSubj: an unvalidated invalidOperand traces as non-matching,
+		//labeled with its original value, rather than panicking.
+		return &Trace{Label: fmt.Sprintf("%v", s), Leaf: true, Result: false}
+	}
+}
+
+//Explain evaluates the given feature set against the logic expression, like Eval,
+//but returns the full reasoning as a Trace instead of discarding it. Unlike Eval,
+//it does not short-circuit: every operand is evaluated so its outcome can be
+//reported.
+func (x Expression) Explain(features []string) *Trace {
+	t := &Trace{Label: x.verb, Items: make([]*Trace, 0, len(x.subj))}
+	if x.verb == "none_of" {
+		t.Result = true
+		for _, s := range x.subj {
+			it := explainSubj(s, features)
+			t.Items = append(t.Items, it)
+			if it.Result {
+				t.Result = false
+			}
+		}
+		return t
+	}
+	rate := x.rate
+	if rate < 0 {
+		rate = len(x.subj)
+	}
+	t.Rate = rate
+	for _, s := range x.subj {
+		it := explainSubj(s, features)
+		t.Items = append(t.Items, it)
+		if it.Result {
+			t.Hit++
+		}
+	}
+	//like evalPos, an expression with no operands never matches
+	t.Result = len(x.subj) > 0 && t.Hit >= rate
+	return t
+}
+
+//String renders the Trace as an indented, YAML-shaped explanation, e.g.:
+//
+//    all_of [false]
+//      - item1 [true]
+//      - any_of [false, 0/1]
+//        - item2 [false]
+//        - item3 [false]
+func (t *Trace) String() string {
+	var buf bytes.Buffer
+	t.write(&buf, 0, false)
+	return buf.String()
+}
+
+func (t *Trace) write(buf *bytes.Buffer, depth int, item bool) {
+	indent := strings.Repeat("  ", depth)
+	prefix := ""
+	if item {
+		prefix = "- "
+	}
+	fmt.Fprintf(buf, "%s%s%s\n", indent, prefix, t.line())
+	for _, c := range t.Items {
+		c.write(buf, depth+1, true)
+	}
+}
+
+func (t *Trace) line() string {
+	if t.Leaf || t.Label == "all_of" || t.Label == "none_of" {
+		return fmt.Sprintf("%s [%v]", t.Label, t.Result)
+	}
+	return fmt.Sprintf("%s [%v, %d/%d]", t.Label, t.Result, t.Hit, t.Rate)
+}
+
+//invalidOperand marks a builder operand that was rejected at build time (an
+//unsupported type, or a "~"/"@" token that failed to compile), so the problem
+//can be reported by Validate instead of panicking from a constructor that has
+//no error return, or being silently mistreated as a literal by eval/Explain.
+type invalidOperand struct {
+	v   interface{}
+	err error
+}
+
+//compileOperand mirrors the per-item handling in load: a "~"-prefixed string
+//becomes a compiled *regexp.Regexp and a "@prefix:arg" string becomes a
+//compiled matcherToken, so builder-constructed expressions behave exactly
+//like parsed ones without requiring a separate compile step before Eval.
+func compileOperand(it interface{}) interface{} {
+	switch v := it.(type) {
+	case string:
+		if strings.HasPrefix(v, "~") {
+			rx, err := regexp.Compile(v[1:])
+			if err != nil {
+				return invalidOperand{v: v, err: fmt.Errorf("invalid regex %q: %v", v, err)}
+			}
+			return rx
+		}
+		if prefix, arg, ok := parseMatcherToken(v); ok {
+			m, err := compileMatcher(prefix, arg)
+			if err != nil {
+				return invalidOperand{v: v, err: fmt.Errorf("invalid matcher %q: %v", v, err)}
+			}
+			return matcherToken{label: v, m: m}
+		}
+		return v
+	case *Expression:
+		return v
+	default:
+		return invalidOperand{v: it, err: fmt.Errorf("invalid operand: %v", it)}
+	}
+}
+
+func build(verb string, rate int, items []interface{}) *Expression {
+	s := make([]interface{}, len(items))
+	for i, it := range items {
+		s[i] = compileOperand(it)
+	}
+	return &Expression{verb: verb, rate: rate, subj: s}
+}
+
+//AllOf builds an "all_of" Expression from the given operands, each of which
+//must be a feature string (optionally "~"-prefixed for a regex, or
+//"@prefix:arg" for a registered Matcher) or a nested *Expression. Regex and
+//matcher operands are compiled immediately, same as when parsing; a bad
+//pattern or an unsupported operand type does not panic, but is evaluated as
+//non-matching until Validate is called, which turns it into a proper error.
+func AllOf(items ...interface{}) *Expression {
+	return build("all_of", -1, items)
+}
+
+//AnyOf builds an "any_of" Expression from the given operands. See AllOf.
+func AnyOf(items ...interface{}) *Expression {
+	return build("any_of", 1, items)
+}
+
+//NoneOf builds a "none_of" Expression from the given operands. See AllOf.
+func NoneOf(items ...interface{}) *Expression {
+	return build("none_of", 0, items)
+}
+
+//NOf builds an "n_of" Expression requiring at least n of the given operands
+//to match. For n of 0 it builds a "none_of" Expression instead, which
+//requires that none of the operands match. See AllOf.
+func NOf(n int, items ...interface{}) *Expression {
+	verb := fmt.Sprintf("%d_of", n)
+	if n == 0 {
+		verb = "none_of"
+	}
+	return build(verb, n, items)
+}
+
+//Validate checks that the expression tree is well-formed: the verb is one of
+//the recognized forms, rate is non-negative (except for all_of's internal
+//sentinel), every operand is a feature string, a compiled regex, a compiled
+//matcher, or a nested *Expression, and subj is non-empty. Operands are already
+//compiled by the time Validate runs (load and the builder functions both
+//compile "~"/"@" tokens eagerly); Validate's job is to surface any operand
+//that failed to compile, or was otherwise rejected, as an error instead of
+//letting it silently evaluate as non-matching.
+func (x *Expression) Validate() error {
+	switch x.verb {
+	case "all_of", "any_of", "none_of":
+	default:
+		if !strings.HasSuffix(x.verb, "_of") {
+			return fmt.Errorf("invalid verb: %v", x.verb)
+		}
+		if _, err := strconv.Atoi(x.verb[:len(x.verb)-3]); err != nil {
+			return fmt.Errorf("invalid verb: %v", x.verb)
+		}
+	}
+	if x.rate < 0 && x.verb != "all_of" {
+		return fmt.Errorf("rate must be non-negative for %s", x.verb)
+	}
+	if len(x.subj) == 0 {
+		return fmt.Errorf("expression has no operands")
+	}
+	for _, s := range x.subj {
+		switch v := s.(type) {
+		case string, *regexp.Regexp, matcherToken:
+		case *Expression:
+			if err := v.Validate(); err != nil {
+				return err
+			}
+		case invalidOperand:
+			return v.err
+		default:
+			return fmt.Errorf("invalid operand: %v", s)
+		}
+	}
+	return nil
+}
+
+//Features returns the plain-string form of every leaf operand directly under
+//x: feature tokens, "~"-prefixed regex patterns, and "@prefix:arg" matcher
+//tokens. It does not recurse into nested expressions; combine with Walk to
+//collect tokens across an entire tree, e.g. for an autocompletion UI:
+//
+//    var names []string
+//    root.Walk(func(e *Expression) error {
+//        names = append(names, e.Features()...)
+//        return nil
+//    })
+func (x Expression) Features() []string {
+	var out []string
+	for _, s := range x.subj {
+		switch v := s.(type) {
+		case string:
+			out = append(out, v)
+		case *regexp.Regexp:
+			out = append(out, "~"+v.String())
+		case matcherToken:
+			out = append(out, v.label)
+		}
+	}
+	return out
+}
+
+//Walk calls fn for x and then, depth-first, for every nested *Expression in
+//its operands. It stops and returns the first error fn returns. This lets
+//callers lint or transform a tree; combine with Features to read the leaf
+//tokens at each node (see Features for an example).
+func (x *Expression) Walk(fn func(*Expression) error) error {
+	if err := fn(x); err != nil {
+		return err
+	}
+	for _, s := range x.subj {
+		if sub, ok := s.(*Expression); ok {
+			if err := sub.Walk(fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package logic
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path"
+	"sync"
 	"testing"
 
 	"gopkg.in/yaml.v2"
@@ -37,6 +40,16 @@ func TestLoad(t *testing.T) {
 	t.Log("Parse() successful")
 }
 
+func TestLoadBadRegex(t *testing.T) {
+	_, err := Parse(`any_of: ["~("]`)
+	if err == nil {
+		t.Log("expected a parse error for malformed regex, got nil")
+		t.Fail()
+		return
+	}
+	t.Logf("Parse() correctly rejected malformed regex: %v", err)
+}
+
 func TestUnmarshal(t *testing.T) {
 	var x Expression
 	err := yaml.Unmarshal([]byte(EXPRESSION), &x)
@@ -83,6 +96,58 @@ func TestEvalFail2(t *testing.T) {
 	t.Log("evaluation successful")
 }
 
+func TestLoadFormatJSON(t *testing.T) {
+	x, err := ParseFormat(`{"and": ["item1", {"or": ["item2", "item3"]}, {"not": ["~extra"]}]}`, JSON)
+	if err != nil {
+		t.Logf("ParseFormat(JSON) failed: %v", err)
+		t.Fail()
+		return
+	}
+	if !x.Eval([]string{"item1", "item3"}) {
+		t.Log("expected true, got false")
+		t.Fail()
+		return
+	}
+	t.Log("ParseFormat(JSON) successful")
+}
+
+func TestLoadFormatTOML(t *testing.T) {
+	x, err := ParseFormat("and = [\"item1\", \"item2\"]\n", TOML)
+	if err != nil {
+		t.Logf("ParseFormat(TOML) failed: %v", err)
+		t.Fail()
+		return
+	}
+	if !x.Eval([]string{"item1", "item2"}) {
+		t.Log("expected true, got false")
+		t.Fail()
+		return
+	}
+	t.Log("ParseFormat(TOML) successful")
+}
+
+func TestSaveJSON(t *testing.T) {
+	x, _ := Parse(EXPRESSION)
+	var buf bytes.Buffer
+	if err := x.SaveJSON(&buf); err != nil {
+		t.Logf("SaveJSON failed: %v", err)
+		t.Fail()
+		return
+	}
+	y, err := ParseFormat(buf.String(), JSON)
+	if err != nil {
+		t.Logf("re-parsing saved JSON failed: %v", err)
+		t.Fail()
+		return
+	}
+	if !y.Eval([]string{"item1", "item3"}) {
+		t.Log("expected true, got false")
+		t.Fail()
+		return
+	}
+	t.Log("SaveJSON successful")
+}
+
 func TestMultiSelection(t *testing.T) {
 	x, _ := Parse(EXPMULTI)
 	if !x.Eval([]string{"item1", "item2", "item4"}) {
@@ -139,3 +204,265 @@ and:
 	//- none_of:
 	//   - ~extra
 }
+
+func TestBuilder(t *testing.T) {
+	x := AllOf("item1", AnyOf("item2", "item3"), NoneOf("~extra"))
+	if err := x.Validate(); err != nil {
+		t.Logf("Validate() failed: %v", err)
+		t.Fail()
+		return
+	}
+	if !x.Eval([]string{"item1", "item3"}) {
+		t.Log("expected true, got false")
+		t.Fail()
+		return
+	}
+	t.Log("builder evaluation successful")
+}
+
+func TestBuilderRegexWithoutValidate(t *testing.T) {
+	x := AnyOf("~^item")
+	if !x.Eval([]string{"item1"}) {
+		t.Log("expected true: a builder \"~\"-prefixed operand must be treated as a regex even without calling Validate")
+		t.Fail()
+		return
+	}
+	t.Log("builder regex operand matched without an explicit Validate() call")
+}
+
+func TestBuilderInvalidOperandDoesNotPanic(t *testing.T) {
+	x := AnyOf(42)
+	if x.Eval([]string{"42"}) {
+		t.Log("expected false for an unrecognized operand type")
+		t.Fail()
+		return
+	}
+	if err := x.Validate(); err == nil {
+		t.Log("expected Validate() to report the invalid operand, got nil")
+		t.Fail()
+		return
+	}
+	t.Log("invalid builder operand evaluated as non-matching and was reported by Validate()")
+}
+
+func TestValidateBadRegex(t *testing.T) {
+	x := AnyOf("~(")
+	if err := x.Validate(); err == nil {
+		t.Log("expected error for malformed regex, got nil")
+		t.Fail()
+		return
+	}
+	t.Log("Validate() correctly rejected malformed regex")
+}
+
+func TestValidateEmptySubj(t *testing.T) {
+	x := AllOf()
+	if err := x.Validate(); err == nil {
+		t.Log("expected error for empty operand list, got nil")
+		t.Fail()
+		return
+	}
+	t.Log("Validate() correctly rejected empty operands")
+}
+
+func TestWalk(t *testing.T) {
+	x, _ := Parse(EXPRESSION)
+	var verbs []string
+	err := x.Walk(func(e *Expression) error {
+		verbs = append(verbs, e.verb)
+		return nil
+	})
+	if err != nil {
+		t.Logf("Walk() failed: %v", err)
+		t.Fail()
+		return
+	}
+	if len(verbs) != 3 {
+		t.Logf("expected 3 nodes, got %d: %v", len(verbs), verbs)
+		t.Fail()
+		return
+	}
+	t.Log("Walk() visited all nodes")
+}
+
+func TestWalkFeatures(t *testing.T) {
+	x, _ := Parse(EXPRESSION)
+	var names []string
+	err := x.Walk(func(e *Expression) error {
+		names = append(names, e.Features()...)
+		return nil
+	})
+	if err != nil {
+		t.Logf("Walk() failed: %v", err)
+		t.Fail()
+		return
+	}
+	want := []string{"item1", "item2", "item3", "~extra"}
+	if len(names) != len(want) {
+		t.Logf("expected %v, got %v", want, names)
+		t.Fail()
+		return
+	}
+	for i, w := range want {
+		if names[i] != w {
+			t.Logf("expected %v, got %v", want, names)
+			t.Fail()
+			return
+		}
+	}
+	t.Log("Walk()+Features() collected all leaf tokens")
+}
+
+type globMatcher struct{ pattern string }
+
+func (g globMatcher) Match(features []string) bool {
+	for _, f := range features {
+		if ok, _ := path.Match(g.pattern, f); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	RegisterMatcher("glob", func(arg string) (Matcher, error) {
+		if _, err := path.Match(arg, ""); err != nil {
+			return nil, err
+		}
+		return globMatcher{arg}, nil
+	})
+}
+
+func TestMatcher(t *testing.T) {
+	x, err := Parse("any_of: [\"@glob:item*\"]")
+	if err != nil {
+		t.Logf("Parse() failed: %v", err)
+		t.Fail()
+		return
+	}
+	if !x.Eval([]string{"item42"}) {
+		t.Log("expected true, got false")
+		t.Fail()
+		return
+	}
+	if x.Eval([]string{"other"}) {
+		t.Log("expected false, got true")
+		t.Fail()
+		return
+	}
+	t.Log("matcher evaluation successful")
+}
+
+func TestMatcherUnknownPrefix(t *testing.T) {
+	_, err := Parse("any_of: [\"@nosuch:arg\"]")
+	if err == nil {
+		t.Log("expected error for unknown matcher prefix, got nil")
+		t.Fail()
+		return
+	}
+	t.Log("Parse() correctly rejected unknown matcher prefix")
+}
+
+func TestMatcherBadArg(t *testing.T) {
+	_, err := Parse("any_of: [\"@glob:[\"]")
+	if err == nil {
+		t.Log("expected error for malformed glob pattern, got nil")
+		t.Fail()
+		return
+	}
+	t.Log("Parse() correctly rejected malformed matcher arg")
+}
+
+func TestRegisterMatcherConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			RegisterMatcher(fmt.Sprintf("concurrent%d", i), func(arg string) (Matcher, error) {
+				return globMatcher{arg}, nil
+			})
+		}(i)
+		go func() {
+			defer wg.Done()
+			Parse("any_of: [\"@glob:item*\"]")
+		}()
+	}
+	wg.Wait()
+	t.Log("concurrent RegisterMatcher and Parse did not race")
+}
+
+func TestEvalSet(t *testing.T) {
+	x, _ := Parse(EXPRESSION)
+	fs := NewFeatureSet([]string{"item1", "item3"})
+	if !x.EvalSet(fs) {
+		t.Log("expected true, got false")
+		t.Fail()
+		return
+	}
+	t.Log("EvalSet successful")
+}
+
+func TestEvalSetKeyValue(t *testing.T) {
+	x, err := Parse(`
+---
+and:
+- env=prod
+- or: [region=us-east, region=eu-west]
+`)
+	if err != nil {
+		t.Logf("Parse() failed: %v", err)
+		t.Fail()
+		return
+	}
+	fs := NewFeatureMap(map[string]string{"env": "prod", "region": "us-east"})
+	if !x.EvalSet(fs) {
+		t.Log("expected true, got false")
+		t.Fail()
+		return
+	}
+	fs = NewFeatureMap(map[string]string{"env": "staging", "region": "us-east"})
+	if x.EvalSet(fs) {
+		t.Log("expected false, got true")
+		t.Fail()
+		return
+	}
+	t.Log("EvalSet key/value evaluation successful")
+}
+
+func TestEvalSetKeyValueBareTokenMismatch(t *testing.T) {
+	x, err := Parse(`any_of: ["item1"]`)
+	if err != nil {
+		t.Logf("Parse() failed: %v", err)
+		t.Fail()
+		return
+	}
+	fs := NewFeatureMap(map[string]string{"item1": "somevalue"})
+	if x.EvalSet(fs) {
+		t.Log("expected false: a bare token must not match a kv key of the same name")
+		t.Fail()
+		return
+	}
+	t.Log("EvalSet correctly rejected bare token against key/value feature set")
+}
+
+func ExampleExpression_Explain() {
+	ex, _ := Parse(EXPRESSION)
+	fmt.Println(ex.Explain([]string{"item1", "item2", "extra_item"}))
+	//Output: all_of [false]
+	//   - item1 [true]
+	//   - any_of [true, 1/1]
+	//     - item2 [true]
+	//     - item3 [false]
+	//   - none_of [false]
+	//     - ~extra [true]
+}
+
+func BenchmarkEval(b *testing.B) {
+	x, _ := Parse(EXPRESSION)
+	features := []string{"item1", "item3", "extra_item"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Eval(features)
+	}
+}